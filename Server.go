@@ -2,37 +2,72 @@ package main
 
 import (
 	"bufio"
+	"database/sql"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+var nameRegex = regexp.MustCompile(`^[0-9a-zA-Z_-]{3,36}$`)
+
 const (
 	ConnPort = ":3333"
 	ConnType = "tcp"
 
 	MaxClients = 10
 
-	CmdPrefix = "/"
-	CmdCreate = CmdPrefix + "create"
-	CmdList   = CmdPrefix + "list"
-	CmdJoin   = CmdPrefix + "join"
-	CmdLeave  = CmdPrefix + "leave"
-	CmdHelp   = CmdPrefix + "help"
-	CmdName   = CmdPrefix + "name"
-	CmdQuit   = CmdPrefix + "quit"
+	CmdPrefix   = "/"
+	CmdCreate   = CmdPrefix + "create"
+	CmdList     = CmdPrefix + "list"
+	CmdJoin     = CmdPrefix + "join"
+	CmdLeave    = CmdPrefix + "leave"
+	CmdHelp     = CmdPrefix + "help"
+	CmdName     = CmdPrefix + "name"
+	CmdQuit     = CmdPrefix + "quit"
+	CmdBan      = CmdPrefix + "ban"
+	CmdKick     = CmdPrefix + "kick"
+	CmdOp       = CmdPrefix + "op"
+	CmdRegister = CmdPrefix + "register"
+	CmdIdentify = CmdPrefix + "identify"
+	CmdMsg      = CmdPrefix + "msg"
+	CmdNames    = CmdPrefix + "names"
+	CmdWhois    = CmdPrefix + "whois"
+	CmdTopic    = CmdPrefix + "topic"
+	CmdHistory  = CmdPrefix + "history"
+	CmdSearch   = CmdPrefix + "search"
 
 	ClientName = "Anonymous"
 	ServerName = "Server"
 
-	ErrorPrefix = "Error: "
-	ErrorSend   = ErrorPrefix + "You cannot send messages in the lobby.\n"
-	ErrorCreate = ErrorPrefix + "A chat room with that name already exists.\n"
-	ErrorJoin   = ErrorPrefix + "A chat room with that name does not exist.\n"
-	ErrorLeave  = ErrorPrefix + "You cannot leave the lobby.\n"
+	ErrorPrefix         = "Error: "
+	ErrorSend           = ErrorPrefix + "You cannot send messages in the lobby.\n"
+	ErrorCreate         = ErrorPrefix + "A chat room with that name already exists.\n"
+	ErrorJoin           = ErrorPrefix + "A chat room with that name does not exist.\n"
+	ErrorLeave          = ErrorPrefix + "You cannot leave the lobby.\n"
+	ErrorPermission     = ErrorPrefix + "You do not have permission to do that.\n"
+	ErrorNoSuchUser     = ErrorPrefix + "No user with that name is connected.\n"
+	ErrorInputLong      = ErrorPrefix + "Your message was too long and was dropped.\n"
+	ErrorRateLimited    = ErrorPrefix + "You are sending messages too quickly.\n"
+	ErrorTooManyConn    = ErrorPrefix + "Too many connections from your address.\n"
+	ErrorNameRegistered = ErrorPrefix + "That name is registered. Use /identify <password> to use it.\n"
+	ErrorIdentifyFailed = ErrorPrefix + "Incorrect name or password.\n"
+	ErrorRegisterUsage  = ErrorPrefix + "Usage: /register <password>\n"
+	ErrorMsgUsage       = ErrorPrefix + "Usage: /msg <user> <text>\n"
+	ErrorInvalidName    = ErrorPrefix + "Names must be 3-36 characters of letters, numbers, underscores or hyphens.\n"
+	ErrorNameTaken      = ErrorPrefix + "That name is already in use.\n"
+	ErrorNotInRoom      = ErrorPrefix + "You are not in a chat room.\n"
+	ErrorHistoryUsage   = ErrorPrefix + "Usage: /history <n>\n"
+	ErrorSearchUsage    = ErrorPrefix + "Usage: /search <keyword>\n"
 
 	NoticePrefix         = "Notice: "
 	NoticeRoomJoin       = NoticePrefix + "\"%s\" joined the chat room.\n"
@@ -41,9 +76,19 @@ const (
 	NoticeRoomDelete     = NoticePrefix + "Chat room is inactive and being deleted.\n"
 	NoticePersonalCreate = NoticePrefix + "Created chat room \"%s\".\n"
 	NoticePersonalName   = NoticePrefix + "Changed name to \"\".\n"
+	NoticePersonalKick   = NoticePrefix + "Kicked \"%s\".\n"
+	NoticePersonalBan    = NoticePrefix + "Banned \"%s\".\n"
+	NoticePersonalOp     = NoticePrefix + "\"%s\" is now an operator.\n"
+	NoticePersonalReg    = NoticePrefix + "Registered the name \"%s\".\n"
+	NoticePersonalIdent  = NoticePrefix + "Identified as \"%s\".\n"
+	NoticeShutdown       = NoticePrefix + "Server is shutting down. Goodbye!\n"
+	NoticeDirectMessage  = "(private) %s: %s\n"
+	NoticeWhois          = NoticePrefix + "\"%s\" is in %s, connected at %s.\n"
+	NoticeRoomTopic      = NoticePrefix + "\"%s\" changed the topic to \"%s\".\n"
 
 	MsgConnect = "Welcome to the server! Type \"/help\" to get a list of commands.\n"
 	MsgFull    = "Server is full. Please try reconnecting later."
+	MsgPing    = "Notice: Still there? Send anything to stay connected.\n"
 
 	ExpiryTime time.Duration = 7 * 24 * time.Hour
 )
@@ -58,17 +103,39 @@ type Lobby struct {
 	join      chan *Client
 	leave     chan *Client
 	delete    chan *ChatRoom
+	auth      *Auth
+	users     *Users
+	historyDB *sql.DB
 }
 
-/* Creates a lobby which beings listening over its channels */
-func NewLobby() *Lobby {
+/* Creates a lobby which beings listening over its channels.
+The given Auth subsystem governs who may use operator commands such as /ban, /kick and /op.
+The given Users tracks registered nicknames, chatRooms seeds the lobby with any
+rooms reloaded from a previous run's persisted state, and historyDB, if non-nil,
+backs every new chat room's history with SQLite instead of an in-memory ring buffer */
+func NewLobby(auth *Auth, users *Users, chatRooms map[string]*ChatRoom, historyDB *sql.DB) *Lobby {
+	if chatRooms == nil {
+		chatRooms = make(map[string]*ChatRoom)
+	}
+
 	lobby := &Lobby{
 		clients:   make([]*Client, 0),
-		chatRooms: make(map[string]*ChatRoom),
+		chatRooms: chatRooms,
 		incoming:  make(chan *Message),
 		join:      make(chan *Client),
 		leave:     make(chan *Client),
 		delete:    make(chan *ChatRoom),
+		auth:      auth,
+		users:     users,
+		historyDB: historyDB,
+	}
+
+	for _, chatRoom := range lobby.chatRooms {
+		room := chatRoom
+		go func() {
+			time.Sleep(time.Until(room.expiry))
+			lobby.delete <- room
+		}()
 	}
 
 	lobby.Listen()
@@ -93,15 +160,29 @@ func (lobby *Lobby) Listen() {
 	}()
 }
 
-/* Handles clients connecting to the lobby */
+/* Handles clients connecting to the lobby. A name a transport defaulted
+the client to (e.g. an SSH username) that happens to be registered and
+unidentified is reset to ClientName first, so a connecting client can
+never keep a registered identity it never authenticated for */
 func (lobby *Lobby) Join(client *Client) {
 	if len(lobby.clients) >= MaxClients {
-		client.Quit()
+		client.reject()
 		return
 	}
 
+	if lobby.CountByIP(client.IP()) >= *maxConnsPerIP {
+		client.Send(ErrorTooManyConn)
+		client.reject()
+		return
+	}
+
+	if lobby.users.IsRegistered(client.name) && client.authedAs != client.name {
+		client.name = ClientName
+	}
+
+	client.name = lobby.uniqueName(client.name)
 	lobby.clients = append(lobby.clients, client)
-	client.outgoing <- MsgConnect
+	client.Send(MsgConnect)
 
 	go func() {
 		for message := range client.incoming {
@@ -125,6 +206,10 @@ func (lobby *Lobby) Leave(client *Client) {
 		}
 	}
 
+	client.mutex.Lock()
+	client.closed = true
+	client.mutex.Unlock()
+
 	close(client.outgoing)
 	log.Println("Closed client's outgoing channel")
 }
@@ -149,40 +234,345 @@ func (lobby *Lobby) DeleteChatRoom(chatRoom *ChatRoom) {
 /* Handles messages sent to the lobby
 If the message contains a command, the command is executed by the lobby
 Otherwise, the message is sent to the sender's current chatroom */
+/* Reports whether text invokes cmd specifically, rather than merely
+starting with it - e.g. "/names" is not a match for cmd "/name" even
+though strings.HasPrefix would say otherwise */
+func isCommand(text, cmd string) bool {
+	if !strings.HasPrefix(text, cmd) {
+		return false
+	}
+
+	rest := strings.TrimSuffix(text[len(cmd):], "\n")
+	return rest == "" || strings.HasPrefix(rest, " ")
+}
+
 func (lobby *Lobby) Parse(message *Message) {
 	switch {
 	default:
 		lobby.SendMessage(message)
-	case strings.HasPrefix(message.text, CmdCreate):
+	case isCommand(message.text, CmdCreate):
 		name := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdCreate+" "), "\n")
 		lobby.CreateChatRoom(message.client, name)
-	case strings.HasPrefix(message.text, CmdList):
+	case isCommand(message.text, CmdList):
 		lobby.ListChatRooms(message.client)
-	case strings.HasPrefix(message.text, CmdJoin):
+	case isCommand(message.text, CmdJoin):
 		name := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdJoin+" "), "\n")
 		lobby.JoinChatRoom(message.client, name)
-	case strings.HasPrefix(message.text, CmdLeave):
+	case isCommand(message.text, CmdLeave):
 		lobby.LeaveChatRoom(message.client)
-	case strings.HasPrefix(message.text, CmdName):
+	case isCommand(message.text, CmdNames):
+		lobby.ListNames(message.client)
+	case isCommand(message.text, CmdName):
 		name := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdName+" "), "\n")
 		lobby.ChangeName(message.client, name)
-	case strings.HasPrefix(message.text, CmdHelp):
+	case isCommand(message.text, CmdHelp):
 		lobby.Help(message.client)
-	case strings.HasPrefix(message.text, CmdQuit):
+	case isCommand(message.text, CmdQuit):
 		message.client.Quit()
+	case isCommand(message.text, CmdKick):
+		name := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdKick+" "), "\n")
+		lobby.KickClient(message.client, name)
+	case isCommand(message.text, CmdBan):
+		name := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdBan+" "), "\n")
+		lobby.BanClient(message.client, name)
+	case isCommand(message.text, CmdOp):
+		name := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdOp+" "), "\n")
+		lobby.OpClient(message.client, name)
+	case isCommand(message.text, CmdRegister):
+		password := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdRegister+" "), "\n")
+		lobby.RegisterUser(message.client, password)
+	case isCommand(message.text, CmdIdentify):
+		password := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdIdentify+" "), "\n")
+		lobby.IdentifyUser(message.client, password)
+	case isCommand(message.text, CmdMsg):
+		rest := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdMsg+" "), "\n")
+		parts := strings.SplitN(rest, " ", 2)
+		if len(parts) < 2 {
+			message.client.Send(ErrorMsgUsage)
+			return
+		}
+		lobby.DirectMessage(message.client, parts[0], parts[1])
+	case isCommand(message.text, CmdWhois):
+		name := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdWhois+" "), "\n")
+		lobby.Whois(message.client, name)
+	case isCommand(message.text, CmdTopic):
+		topic := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdTopic+" "), "\n")
+		lobby.SetTopic(message.client, topic)
+	case isCommand(message.text, CmdHistory):
+		arg := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdHistory+" "), "\n")
+		lobby.ShowHistory(message.client, arg)
+	case isCommand(message.text, CmdSearch):
+		keyword := strings.TrimSuffix(strings.TrimPrefix(message.text, CmdSearch+" "), "\n")
+		lobby.SearchHistory(message.client, keyword)
+	}
+}
+
+/* Sends the client the last n messages from their chat room's history store */
+func (lobby *Lobby) ShowHistory(client *Client, arg string) {
+	if client.chatRoom == nil {
+		client.Send(ErrorNotInRoom)
+		return
+	}
+
+	n, err := strconv.Atoi(arg)
+	if err != nil || n <= 0 {
+		client.Send(ErrorHistoryUsage)
+		return
+	}
+
+	client.Send("\n")
+	for _, msg := range client.chatRoom.history.Recent(n) {
+		client.Send(msg)
+	}
+	client.Send("\n")
+	log.Println("Client requested chatroom history")
+}
+
+/* Sends the client every message in their chat room's history store
+containing the given keyword */
+func (lobby *Lobby) SearchHistory(client *Client, keyword string) {
+	if client.chatRoom == nil {
+		client.Send(ErrorNotInRoom)
+		return
+	}
+
+	if keyword == "" {
+		client.Send(ErrorSearchUsage)
+		return
+	}
+
+	client.Send("\n")
+	for _, msg := range client.chatRoom.history.Since(time.Time{}) {
+		if strings.Contains(msg, keyword) {
+			client.Send(msg)
+		}
+	}
+	client.Send("\n")
+	log.Println("Client searched chatroom history")
+}
+
+/* Delivers a message directly to the named client's outgoing channel,
+regardless of which chat room either client is currently in */
+func (lobby *Lobby) DirectMessage(client *Client, name, text string) {
+	target := lobby.FindClient(name)
+	if target == nil {
+		client.Send(ErrorNoSuchUser)
+		return
+	}
+
+	target.SendFrom(fmt.Sprintf(NoticeDirectMessage, client.name, text), client.name, "", time.Now())
+	log.Println("Client sent a private message")
+}
+
+/* Lists the names of every client currently in the client's chat room */
+func (lobby *Lobby) ListNames(client *Client) {
+	if client.chatRoom == nil {
+		client.Send(ErrorSend)
+		return
+	}
+
+	client.Send("\n")
+	client.Send("Names:\n")
+	for _, other := range client.chatRoom.clients {
+		client.Send(fmt.Sprintf("%s\n", other.name))
+	}
+
+	client.Send("\n")
+	log.Println("Client listed names in chatroom")
+}
+
+/* Reports the named client's current chat room and connection time */
+func (lobby *Lobby) Whois(client *Client, name string) {
+	target := lobby.FindClient(name)
+	if target == nil {
+		client.Send(ErrorNoSuchUser)
+		return
+	}
+
+	room := "the lobby"
+	if target.chatRoom != nil {
+		room = fmt.Sprintf("\"%s\"", target.chatRoom.name)
+	}
+
+	client.Send(fmt.Sprintf(NoticeWhois, target.name, room, target.ctime.Format(time.Kitchen)))
+	log.Println("Client looked up another client")
+}
+
+/* Sets the topic of the client's current chat room, provided the client
+is either the room's creator or a server operator - the same owner-or-op
+rule KickClient uses, needed here too since a room reloaded from persisted
+state has no owner (a *Client can't be persisted), leaving only operators
+able to set its topic again after a restart */
+func (lobby *Lobby) SetTopic(client *Client, topic string) {
+	if client.chatRoom == nil {
+		client.Send(ErrorNotInRoom)
+		return
+	}
+
+	isRoomOwner := client.chatRoom.owner == client
+	isOp := lobby.auth != nil && lobby.auth.IsOp(client.pubKey)
+	if !isRoomOwner && !isOp {
+		client.Send(ErrorPermission)
+		return
+	}
+
+	client.chatRoom.topic = topic
+	client.chatRoom.Broadcast(fmt.Sprintf(NoticeRoomTopic, client.name, topic))
+	log.Println("Client set the chatroom topic")
+}
+
+/* Registers the client's current name with the given password, provided
+the name is not already registered */
+func (lobby *Lobby) RegisterUser(client *Client, password string) {
+	if password == "" {
+		client.Send(ErrorRegisterUsage)
+		return
+	}
+
+	if !lobby.users.Register(client.name, password) {
+		client.Send(ErrorNameRegistered)
+		return
+	}
+
+	client.authedAs = client.name
+	client.Send(fmt.Sprintf(NoticePersonalReg, client.name))
+	log.Println("Client registered their name")
+}
+
+/* Authenticates the client as the owner of their current name,
+provided the password matches the one it was registered with */
+func (lobby *Lobby) IdentifyUser(client *Client, password string) {
+	if !lobby.users.Identify(client.name, password) {
+		client.Send(ErrorIdentifyFailed)
+		return
+	}
+
+	client.authedAs = client.name
+	client.Send(fmt.Sprintf(NoticePersonalIdent, client.name))
+	log.Println("Client identified")
+}
+
+/* Broadcasts a shutdown notice to every chat room and persists the
+current state, for use before the server process exits */
+func (lobby *Lobby) Shutdown() {
+	for _, chatRoom := range lobby.chatRooms {
+		chatRoom.Broadcast(NoticeShutdown)
+	}
+
+	lobby.SaveState()
+}
+
+/* Counts how many currently connected clients share the given IP address */
+func (lobby *Lobby) CountByIP(ip string) int {
+	count := 0
+	for _, client := range lobby.clients {
+		if client.IP() == ip {
+			count++
+		}
+	}
+
+	return count
+}
+
+/* Returns base if it isn't already in use, otherwise base suffixed with
+the smallest integer that makes it unique. Used to give newly connecting
+clients a name that doesn't collide with one already in the lobby, since
+transports hand clients a default (ClientName) or best-effort name (an
+SSH username) before the lobby has had a chance to check it */
+func (lobby *Lobby) uniqueName(base string) string {
+	if lobby.FindClient(base) == nil {
+		return base
+	}
+
+	for suffix := 2; ; suffix++ {
+		name := fmt.Sprintf("%s%d", base, suffix)
+		if lobby.FindClient(name) == nil {
+			return name
+		}
+	}
+}
+
+/* Finds the currently connected client with the given name, if any */
+func (lobby *Lobby) FindClient(name string) *Client {
+	for _, client := range lobby.clients {
+		if client.name == name {
+			return client
+		}
+	}
+
+	return nil
+}
+
+/* Disconnects the named client from the server, provided the requesting
+client is either a server operator or the owner of the target's chat room */
+func (lobby *Lobby) KickClient(client *Client, name string) {
+	target := lobby.FindClient(name)
+	if target == nil {
+		client.Send(ErrorNoSuchUser)
+		return
+	}
+
+	isRoomOwner := target.chatRoom != nil && target.chatRoom.owner == client
+	isOp := lobby.auth != nil && lobby.auth.IsOp(client.pubKey)
+	if !isRoomOwner && !isOp {
+		client.Send(ErrorPermission)
+		return
+	}
+
+	target.Quit()
+	client.Send(fmt.Sprintf(NoticePersonalKick, name))
+	log.Println("Client kicked another client")
+}
+
+/* Bans the named client's public key fingerprint and disconnects them,
+provided the requesting client is an operator */
+func (lobby *Lobby) BanClient(client *Client, name string) {
+	if lobby.auth == nil || !lobby.auth.IsOp(client.pubKey) {
+		client.Send(ErrorPermission)
+		return
+	}
+
+	target := lobby.FindClient(name)
+	if target == nil {
+		client.Send(ErrorNoSuchUser)
+		return
+	}
+
+	lobby.auth.Ban(target.pubKey)
+	target.Quit()
+	client.Send(fmt.Sprintf(NoticePersonalBan, name))
+	log.Println("Client banned another client")
+}
+
+/* Grants operator status to the named client, provided the requesting
+client is already an operator */
+func (lobby *Lobby) OpClient(client *Client, name string) {
+	if lobby.auth == nil || !lobby.auth.IsOp(client.pubKey) {
+		client.Send(ErrorPermission)
+		return
+	}
+
+	target := lobby.FindClient(name)
+	if target == nil {
+		client.Send(ErrorNoSuchUser)
+		return
 	}
+
+	lobby.auth.Op(target.pubKey)
+	client.Send(fmt.Sprintf(NoticePersonalOp, name))
+	log.Println("Client opped another client")
 }
 
 /* Attempts to send the given message to the client's current chat room
 If they are not in a chat room, an error message is sent to the client */
 func (lobby *Lobby) SendMessage(message *Message) {
 	if message.client.chatRoom == nil {
-		message.client.outgoing <- ErrorSend
+		message.client.Send(ErrorSend)
 		log.Println("Client tried to send message in lobby")
 		return
 	}
 
-	message.client.chatRoom.Broadcast(message.String())
+	message.client.chatRoom.BroadcastMessage(message)
 	log.Println("Client sent message")
 }
 
@@ -190,12 +580,12 @@ func (lobby *Lobby) SendMessage(message *Message) {
 provided that one does not already exist */
 func (lobby *Lobby) CreateChatRoom(client *Client, name string) {
 	if lobby.chatRooms[name] != nil {
-		client.outgoing <- ErrorCreate
+		client.Send(ErrorCreate)
 		log.Println("Client tried to create a chatroom with a name already in use")
 		return
 	}
 
-	chatRoom := NewChatRoom(name)
+	chatRoom := NewChatRoom(name, client, lobby.NewHistoryStore(name))
 	lobby.chatRooms[name] = chatRoom
 
 	go func() {
@@ -203,7 +593,7 @@ func (lobby *Lobby) CreateChatRoom(client *Client, name string) {
 		lobby.delete <- chatRoom
 	}()
 
-	client.outgoing <- fmt.Sprintf(NoticePersonalCreate, chatRoom.name)
+	client.Send(fmt.Sprintf(NoticePersonalCreate, chatRoom.name))
 	log.Println("Client created chatroom")
 }
 
@@ -211,7 +601,7 @@ func (lobby *Lobby) CreateChatRoom(client *Client, name string) {
 provided that the chat room exists */
 func (lobby *Lobby) JoinChatRoom(client *Client, name string) {
 	if lobby.chatRooms[name] == nil {
-		client.outgoing <- ErrorJoin
+		client.Send(ErrorJoin)
 		log.Println("Client tried to join a chat room that does not exist")
 		return
 	}
@@ -227,7 +617,7 @@ func (lobby *Lobby) JoinChatRoom(client *Client, name string) {
 /* Removes the given client from their current chatroom */
 func (lobby *Lobby) LeaveChatRoom(client *Client) {
 	if client.chatRoom == nil {
-		client.outgoing <- ErrorLeave
+		client.Send(ErrorLeave)
 		log.Println("Client tried to leave the lobby")
 		return
 	}
@@ -236,10 +626,27 @@ func (lobby *Lobby) LeaveChatRoom(client *Client) {
 	log.Println("Client left the chatroom")
 }
 
-/* Changes the client's name to the given name */
+/* Changes the client's name to the given name, provided it is well-formed,
+not already in use by another connected client, and not registered to
+someone else who has not identified for it */
 func (lobby *Lobby) ChangeName(client *Client, name string) {
+	if !nameRegex.MatchString(name) {
+		client.Send(ErrorInvalidName)
+		return
+	}
+
+	if lobby.users.IsRegistered(name) && client.authedAs != name {
+		client.Send(ErrorNameRegistered)
+		return
+	}
+
+	if existing := lobby.FindClient(name); existing != nil && existing != client {
+		client.Send(ErrorNameTaken)
+		return
+	}
+
 	if client.chatRoom == nil {
-		client.outgoing <- fmt.Sprintf(NoticePersonalName, name)
+		client.Send(fmt.Sprintf(NoticePersonalName, name))
 	} else {
 		client.chatRoom.Broadcast(fmt.Sprintf(NoticeRoomName, client.name, name))
 	}
@@ -250,61 +657,85 @@ func (lobby *Lobby) ChangeName(client *Client, name string) {
 
 /* Sends to the client the list of chat rooms currently open */
 func (lobby *Lobby) ListChatRooms(client *Client) {
-	client.outgoing <- "\n"
-	client.outgoing <- "Chat Rooms:\n"
+	client.Send("\n")
+	client.Send("Chat Rooms:\n")
 	for name := range lobby.chatRooms {
-		client.outgoing <- fmt.Sprintf("%s\n", name)
+		client.Send(fmt.Sprintf("%s\n", name))
 	}
 
-	client.outgoing <- "\n"
+	client.Send("\n")
 	log.Println("Client listed chatrooms")
 }
 
 /* Sends to the client the list of possible commands to the client */
 func (lobby *Lobby) Help(client *Client) {
-	client.outgoing <- "\n"
-	client.outgoing <- "Commands:\n"
-	client.outgoing <- "/help - lists all commands\n"
-	client.outgoing <- "/list - lists all chatrooms\n"
-	client.outgoing <- "/create foo - creates a chatroom named foo\n"
-	client.outgoing <- "/join foo - joins a chatroom named foo\n"
-	client.outgoing <- "/leave - leaves the current chatroom\n"
-	client.outgoing <- "/name foo - changes your name to foo\n"
-	client.outgoing <- "/quit - quits the program\n"
-	client.outgoing <- "\n"
+	client.Send("\n")
+	client.Send("Commands:\n")
+	client.Send("/help - lists all commands\n")
+	client.Send("/list - lists all chatrooms\n")
+	client.Send("/create foo - creates a chatroom named foo\n")
+	client.Send("/join foo - joins a chatroom named foo\n")
+	client.Send("/leave - leaves the current chatroom\n")
+	client.Send("/name foo - changes your name to foo\n")
+	client.Send("/quit - quits the program\n")
+	client.Send("/kick foo - disconnects foo (operators only)\n")
+	client.Send("/ban foo - disconnects and bans foo (operators only)\n")
+	client.Send("/op foo - grants foo operator status (operators only)\n")
+	client.Send("/register foo - registers your current name with the password foo\n")
+	client.Send("/identify foo - authenticates as your current name with the password foo\n")
+	client.Send("/msg foo hello - sends a private message to foo\n")
+	client.Send("/names - lists the users in your current chatroom\n")
+	client.Send("/whois foo - reports foo's current room and connection time\n")
+	client.Send("/topic foo - sets the chatroom's topic (room creator only)\n")
+	client.Send("/history 20 - shows the last 20 messages in your chatroom\n")
+	client.Send("/search foo - searches your chatroom's history for foo\n")
+	client.Send("\n")
 	log.Println("Client requested help")
 }
 
 /* A chatroom contains the chat's name,
 a list of the currently connected clients,
-a history of the messages broadcast to the users in the channel,
- and the current time at which the chatroom will expire */
+a pluggable store of the messages broadcast to the users in the channel,
+the current time at which the chatroom will expire,
+and the client who created it, who may set its topic and kick others from it */
 type ChatRoom struct {
-	name     string
-	clients  []*Client
-	messages []string
-	expiry   time.Time
+	name    string
+	clients []*Client
+	history HistoryStore
+	expiry  time.Time
+	owner   *Client
+	topic   string
 }
 
-/* Creates an empty chatroom with the given name,
+/* Creates an empty chatroom with the given name, owner and history store,
 and sets its expiry time to the current time + EXPIRY_TIME */
-func NewChatRoom(name string) *ChatRoom {
+func NewChatRoom(name string, owner *Client, history HistoryStore) *ChatRoom {
 	return &ChatRoom{
-		name:     name,
-		clients:  make([]*Client, 0),
-		messages: make([]string, 0),
-		expiry:   time.Now().Add(ExpiryTime),
+		name:    name,
+		clients: make([]*Client, 0),
+		history: history,
+		expiry:  time.Now().Add(ExpiryTime),
+		owner:   owner,
 	}
 }
 
+/* Creates the HistoryStore a new chat room should use: SQLite-backed if
+a history database was configured, or an in-memory ring buffer otherwise */
+func (lobby *Lobby) NewHistoryStore(name string) HistoryStore {
+	if lobby.historyDB != nil {
+		return NewSQLiteHistoryStore(lobby.historyDB, name)
+	}
+
+	return NewRingHistoryStore(*historyCap)
+}
+
 /* Adds the given client to the chatroom,
-and sends them all messages that have been sent since the
-creation of the chatroom */
+and replays up to the last ReplayLimit messages from its history store */
 func (chatRoom *ChatRoom) Join(client *Client) {
 	client.chatRoom = chatRoom
 
-	for _, message := range chatRoom.messages {
-		client.outgoing <- message
+	for _, message := range chatRoom.history.Recent(ReplayLimit) {
+		client.Send(message)
 	}
 
 	chatRoom.clients = append(chatRoom.clients, client)
@@ -328,10 +759,24 @@ func (chatRoom *ChatRoom) Leave(client *Client) {
 /* Sends the given message to all clients currently in the chatroom */
 func (chatRoom *ChatRoom) Broadcast(message string) {
 	chatRoom.expiry = time.Now().Add(ExpiryTime)
-	chatRoom.messages = append(chatRoom.messages, message)
+	chatRoom.history.Append(message)
 
 	for _, client := range chatRoom.clients {
-		client.outgoing <- message
+		client.Send(message)
+	}
+}
+
+/* Sends a chat message to all clients currently in the chatroom, recording
+the real sender, room and original send time so that JSON clients get a
+trustworthy envelope instead of one derived from whichever client happens
+to receive it */
+func (chatRoom *ChatRoom) BroadcastMessage(message *Message) {
+	text := message.String()
+	chatRoom.expiry = time.Now().Add(ExpiryTime)
+	chatRoom.history.Append(text)
+
+	for _, client := range chatRoom.clients {
+		client.SendFrom(text, message.client.name, chatRoom.name, message.time)
 	}
 }
 
@@ -345,18 +790,41 @@ func (chatRoom *ChatRoom) Delete() {
 	}
 }
 
+/* outMsg is what's queued on a client's outgoing channel: the formatted
+text line every client writes verbatim, plus the sender, room and send
+time JSON clients need to populate their envelope. From/Room/TS are left
+zero for sends that aren't on behalf of another client (errors, notices,
+pings), and writeJSON falls back to the receiving client's own state for
+those, same as before this type existed */
+type outMsg struct {
+	text string
+	from string
+	room string
+	ts   time.Time
+}
+
 /* A client abstracts away the idea of a connection
 into incoming and outgoing channels,
 and stores some information about the client's state,
 including their current name and chat room */
 type Client struct {
-	name     string
-	chatRoom *ChatRoom
-	incoming chan *Message
-	outgoing chan string
-	conn     net.Conn
-	reader   *bufio.Reader
-	writer   *bufio.Writer
+	name      string
+	pubKey    string
+	authedAs  string
+	format    string
+	chatRoom  *ChatRoom
+	incoming  chan *Message
+	outgoing  chan outMsg
+	conn      net.Conn
+	reader    *bufio.Reader
+	writer    *bufio.Writer
+	atime     time.Time
+	ctime     time.Time
+	limiter   *RateLimiter
+	mutex     sync.Mutex
+	idleTimer *time.Timer
+	quitTimer *time.Timer
+	closed    bool
 }
 
 /* Returns a new client from the given connection,
@@ -370,16 +838,61 @@ func NewClient(conn net.Conn) *Client {
 		name:     ClientName,
 		chatRoom: nil,
 		incoming: make(chan *Message),
-		outgoing: make(chan string),
+		outgoing: make(chan outMsg),
 		conn:     conn,
 		reader:   reader,
 		writer:   writer,
+		atime:    time.Now(),
+		ctime:    time.Now(),
+		limiter:  NewRateLimiter(*rateLimit, *rateBurst),
 	}
 
+	client.idleTimer = time.AfterFunc(*idleTimeout, client.Ping)
 	client.Listen()
 	return client
 }
 
+/* Returns the IP address the client is connecting from */
+func (client *Client) IP() string {
+	host, _, err := net.SplitHostPort(client.conn.RemoteAddr().String())
+	if err != nil {
+		return client.conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+/* Sends the client a keepalive ping after a period of inactivity, then
+starts a quit timer that disconnects them if they remain unresponsive.
+Holds client.mutex across the send so a concurrent Touch can't miss the
+new quitTimer, and so Leave can't close client.outgoing out from under it */
+func (client *Client) Ping() {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.closed {
+		return
+	}
+
+	client.Send(MsgPing)
+	client.quitTimer = time.AfterFunc(*quitTimeout, client.Quit)
+}
+
+/* Records activity from the client and resets its idle and quit timers */
+func (client *Client) Touch() {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.atime = time.Now()
+
+	if client.quitTimer != nil {
+		client.quitTimer.Stop()
+		client.quitTimer = nil
+	}
+
+	client.idleTimer.Reset(*idleTimeout)
+}
+
 /* Starts two threads which read from the client's outgoing channel
 and write to the client's socket connection,
 and read from the client's socket
@@ -394,13 +907,32 @@ formats them into messages, and puts them into
 the client's incoming channel */
 func (client *Client) Read() {
 	for {
-		str, err := client.reader.ReadString('\n')
+		str, err := readLine(client.reader, *maxInputLength)
+		if err == ErrLineTooLong {
+			client.Send(ErrorInputLong)
+			continue
+		}
 		if err != nil {
 			log.Println(err)
 			break
 		}
 
-		message := NewMessage(time.Now(), client, strings.TrimSuffix(str, "\n"))
+		client.Touch()
+
+		if !client.limiter.Allow() {
+			client.Send(ErrorRateLimited)
+			continue
+		}
+
+		text := strings.TrimSuffix(str, "\n")
+		if client.format == FormatJSON {
+			var envelope wsEnvelope
+			if err := json.Unmarshal([]byte(text), &envelope); err == nil {
+				text = envelope.Text
+			}
+		}
+
+		message := NewMessage(time.Now(), client, text)
 		client.incoming <- message
 	}
 
@@ -408,17 +940,34 @@ func (client *Client) Read() {
 	log.Println("Closed client's incoming channel read thread")
 }
 
+/* Queues a plain text line on the client's outgoing channel. writeJSON
+falls back to the client's own name, room and the current time for it,
+which is correct for errors, notices and replies - anything that isn't
+relaying another client's message */
+func (client *Client) Send(text string) {
+	client.outgoing <- outMsg{text: text}
+}
+
+/* Queues text on the client's outgoing channel on behalf of another
+client's message, so that writeJSON reports the real sender, room and
+send time instead of falling back to the recipient's own state */
+func (client *Client) SendFrom(text, from, room string, ts time.Time) {
+	client.outgoing <- outMsg{text: text, from: from, room: room, ts: ts}
+}
+
 /* Reads in messages from the client's outgoing channel,
 and writes them to the client's socket */
 func (client *Client) Write() {
-	for str := range client.outgoing {
-		_, err := client.writer.WriteString(str)
-		if err != nil {
-			log.Println(err)
-			break
+	for msg := range client.outgoing {
+		var err error
+		if client.format == FormatJSON {
+			err = client.writeJSON(msg)
+		} else {
+			if _, err = client.writer.WriteString(msg.text); err == nil {
+				err = client.writer.Flush()
+			}
 		}
 
-		err = client.writer.Flush()
 		if err != nil {
 			log.Println(err)
 			break
@@ -428,14 +977,73 @@ func (client *Client) Write() {
 	log.Println("Closed client's write thread")
 }
 
+/* Wraps a message in the JSON envelope WebSocket clients expect and
+writes it to the client's socket. Uses msg's own from/room/ts when set
+(a relayed message), falling back to the receiving client's own state
+otherwise (an error, notice, or other message with no other sender) */
+func (client *Client) writeJSON(msg outMsg) error {
+	envelope := wsEnvelope{
+		Type: "message",
+		From: msg.from,
+		Room: msg.room,
+		Text: strings.TrimSuffix(msg.text, "\n"),
+		TS:   msg.ts,
+	}
+
+	if envelope.From == "" {
+		envelope.From = client.name
+	}
+
+	if envelope.Room == "" && client.chatRoom != nil {
+		envelope.Room = client.chatRoom.name
+	}
+
+	if envelope.TS.IsZero() {
+		envelope.TS = time.Now()
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.writer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return client.writer.Flush()
+}
+
 /* Closes the client's connection.
 Socket closing is by error checking,
 so this takes advantage of that to simplify the code
 and make sure all the threads are cleaned up */
 func (client *Client) Quit() {
+	client.mutex.Lock()
+	client.idleTimer.Stop()
+	if client.quitTimer != nil {
+		client.quitTimer.Stop()
+	}
+	client.mutex.Unlock()
+
 	client.conn.Close()
 }
 
+/* Quits the client and closes its outgoing channel, for use when Join
+rejects a connection before it was ever added to lobby.clients - such a
+client will never reach Leave, which otherwise does this same cleanup,
+so without it the client's Write goroutine would block on client.outgoing
+forever */
+func (client *Client) reject() {
+	client.Quit()
+
+	client.mutex.Lock()
+	client.closed = true
+	client.mutex.Unlock()
+
+	close(client.outgoing)
+}
+
 /* A Message contains information about the sender,
 the time at which the message was sent,
 and the text of the message.
@@ -461,11 +1069,53 @@ func (message *Message) String() string {
 	return fmt.Sprintf("%s - %s: %s\n", message.time.Format(time.Kitchen), message.client.name, message.text)
 }
 
-/* Creates a lobby, listens for client connections, and connects them to the lobby */
+/* Creates a lobby, listens for client connections, and connects them to the lobby.
+Listens for plain TCP connections by default, or SSH connections if -ssh is passed */
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Parse()
 
-	lobby := NewLobby()
+	auth := NewAuth()
+	for _, fingerprint := range strings.Split(*initialOps, ",") {
+		if fingerprint != "" {
+			auth.Op(fingerprint)
+		}
+	}
+	for _, fingerprint := range strings.Split(*initialWhitelist, ",") {
+		if fingerprint != "" {
+			auth.Whitelist(fingerprint)
+		}
+	}
+
+	var db *sql.DB
+	if *historyDB != "" {
+		var err error
+		db, err = OpenHistoryDB(*historyDB)
+		if err != nil {
+			log.Fatalln("Error opening history database:", err)
+		}
+	}
+
+	chatRooms, users := LoadState(auth, db)
+	lobby := NewLobby(auth, users, chatRooms, db)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Received shutdown signal, saving state")
+		lobby.Shutdown()
+		os.Exit(0)
+	}()
+
+	if *wsEnabled {
+		go ListenWS(lobby)
+	}
+
+	if *sshEnabled {
+		ListenSSH(lobby, auth)
+		return
+	}
 
 	listener, err := net.Listen(ConnType, ConnPort)
 
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"sync"
+)
+
+var (
+	initialOps       = flag.String("ops", "", "comma-separated SSH public key fingerprints to grant operator status at startup")
+	initialWhitelist = flag.String("whitelist", "", "comma-separated SSH public key fingerprints allowed to connect at startup; if set, only whitelisted fingerprints may connect")
+)
+
+/* Auth tracks operator, whitelist and ban status for clients,
+keyed by their SSH public key fingerprint */
+type Auth struct {
+	mutex     sync.RWMutex
+	ops       map[string]bool
+	whitelist map[string]bool
+	bans      map[string]bool
+}
+
+/* Creates an empty Auth subsystem with no ops, whitelisted or banned fingerprints */
+func NewAuth() *Auth {
+	return &Auth{
+		ops:       make(map[string]bool),
+		whitelist: make(map[string]bool),
+		bans:      make(map[string]bool),
+	}
+}
+
+/* Reports whether the given fingerprint belongs to an operator */
+func (auth *Auth) IsOp(fingerprint string) bool {
+	auth.mutex.RLock()
+	defer auth.mutex.RUnlock()
+
+	return fingerprint != "" && auth.ops[fingerprint]
+}
+
+/* Reports whether the given fingerprint is banned */
+func (auth *Auth) IsBanned(fingerprint string) bool {
+	auth.mutex.RLock()
+	defer auth.mutex.RUnlock()
+
+	return auth.bans[fingerprint]
+}
+
+/* Reports whether the given fingerprint may connect.
+Once a whitelist entry has been added, only whitelisted fingerprints are allowed */
+func (auth *Auth) IsAllowed(fingerprint string) bool {
+	auth.mutex.RLock()
+	defer auth.mutex.RUnlock()
+
+	if auth.bans[fingerprint] {
+		return false
+	}
+
+	if len(auth.whitelist) == 0 {
+		return true
+	}
+
+	return auth.whitelist[fingerprint]
+}
+
+/* Grants operator status to the given fingerprint */
+func (auth *Auth) Op(fingerprint string) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+
+	auth.ops[fingerprint] = true
+}
+
+/* Bans the given fingerprint, preventing future connections and
+disconnecting any session already using it */
+func (auth *Auth) Ban(fingerprint string) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+
+	auth.bans[fingerprint] = true
+}
+
+/* Adds the given fingerprint to the connection whitelist */
+func (auth *Auth) Whitelist(fingerprint string) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+
+	auth.whitelist[fingerprint] = true
+}
+
+/* Returns every fingerprint currently granted operator status */
+func (auth *Auth) OpList() []string {
+	auth.mutex.RLock()
+	defer auth.mutex.RUnlock()
+
+	fingerprints := make([]string, 0, len(auth.ops))
+	for fingerprint := range auth.ops {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	return fingerprints
+}
+
+/* Returns every currently banned fingerprint */
+func (auth *Auth) BanList() []string {
+	auth.mutex.RLock()
+	defer auth.mutex.RUnlock()
+
+	fingerprints := make([]string, 0, len(auth.bans))
+	for fingerprint := range auth.bans {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	return fingerprints
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+var (
+	historyCap = flag.Int("history-cap", 200, "maximum number of messages kept in a chat room's in-memory history ring buffer")
+	historyDB  = flag.String("history-db", "", "path to a SQLite database used to persist chat room message history across restarts; disabled if empty")
+)
+
+/* ReplayLimit caps how many past messages a joining client is sent,
+regardless of how much history the room's store actually retains */
+const ReplayLimit = 20
+
+/* HistoryStore is the interface a ChatRoom uses to record and retrieve
+its message history, letting the backing storage be swapped independently
+of the chat logic */
+type HistoryStore interface {
+	Append(msg string)
+	Recent(n int) []string
+	Since(t time.Time) []string
+}
+
+/* Opens (and migrates, if necessary) the SQLite database used to back
+chat room history when -history-db is set */
+func OpenHistoryDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS messages (
+		id    INTEGER PRIMARY KEY AUTOINCREMENT,
+		room  TEXT NOT NULL,
+		text  TEXT NOT NULL,
+		ts    DATETIME NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+/* ringHistoryStore is an in-memory HistoryStore that keeps only the most
+recent cap messages, overwriting the oldest once full */
+type ringHistoryStore struct {
+	mutex   sync.Mutex
+	entries []historyEntry
+	cap     int
+	start   int
+	size    int
+}
+
+type historyEntry struct {
+	text string
+	ts   time.Time
+}
+
+/* Creates an in-memory history store that retains at most cap messages */
+func NewRingHistoryStore(cap int) *ringHistoryStore {
+	return &ringHistoryStore{
+		entries: make([]historyEntry, cap),
+		cap:     cap,
+	}
+}
+
+/* Appends msg to the ring, timestamped with the current time */
+func (store *ringHistoryStore) Append(msg string) {
+	store.append(msg, time.Now())
+}
+
+/* Appends msg to the ring with an explicit timestamp, used to replay
+persisted history without losing when each message was originally sent */
+func (store *ringHistoryStore) append(msg string, ts time.Time) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	index := (store.start + store.size) % store.cap
+	if store.size == store.cap {
+		store.start = (store.start + 1) % store.cap
+	} else {
+		store.size++
+	}
+
+	store.entries[index] = historyEntry{text: msg, ts: ts}
+}
+
+/* Returns up to the n most recent messages, oldest first */
+func (store *ringHistoryStore) Recent(n int) []string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if n > store.size {
+		n = store.size
+	}
+
+	result := make([]string, n)
+	for i := 0; i < n; i++ {
+		index := (store.start + store.size - n + i) % store.cap
+		result[i] = store.entries[index].text
+	}
+
+	return result
+}
+
+/* Returns every retained message sent at or after t, oldest first */
+func (store *ringHistoryStore) Since(t time.Time) []string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	result := make([]string, 0, store.size)
+	for i := 0; i < store.size; i++ {
+		entry := store.entries[(store.start+i)%store.cap]
+		if !entry.ts.Before(t) {
+			result = append(result, entry.text)
+		}
+	}
+
+	return result
+}
+
+/* sqliteHistoryStore is a HistoryStore backed by a shared SQLite database,
+scoped to a single room by name, so history survives server restarts */
+type sqliteHistoryStore struct {
+	db   *sql.DB
+	room string
+}
+
+/* Creates a history store that reads and writes the given room's messages
+in the shared history database */
+func NewSQLiteHistoryStore(db *sql.DB, room string) *sqliteHistoryStore {
+	return &sqliteHistoryStore{db: db, room: room}
+}
+
+/* Appends msg to the database, timestamped with the current time */
+func (store *sqliteHistoryStore) Append(msg string) {
+	_, err := store.db.Exec(`INSERT INTO messages (room, text, ts) VALUES (?, ?, ?)`, store.room, msg, time.Now())
+	if err != nil {
+		log.Println("Error appending chat history:", err)
+	}
+}
+
+/* Returns up to the n most recent messages, oldest first */
+func (store *sqliteHistoryStore) Recent(n int) []string {
+	rows, err := store.db.Query(`SELECT text FROM messages WHERE room = ? ORDER BY id DESC LIMIT ?`, store.room, n)
+	if err != nil {
+		log.Println("Error reading chat history:", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var text string
+		if err := rows.Scan(&text); err != nil {
+			log.Println("Error scanning chat history:", err)
+			continue
+		}
+
+		result = append(result, text)
+	}
+
+	for left, right := 0, len(result)-1; left < right; left, right = left+1, right-1 {
+		result[left], result[right] = result[right], result[left]
+	}
+
+	return result
+}
+
+/* Returns every message sent at or after t, oldest first */
+func (store *sqliteHistoryStore) Since(t time.Time) []string {
+	rows, err := store.db.Query(`SELECT text FROM messages WHERE room = ? AND ts >= ? ORDER BY id ASC`, store.room, t)
+	if err != nil {
+		log.Println("Error reading chat history:", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var text string
+		if err := rows.Scan(&text); err != nil {
+			log.Println("Error scanning chat history:", err)
+			continue
+		}
+
+		result = append(result, text)
+	}
+
+	return result
+}
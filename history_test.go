@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRingHistoryStoreRecent(t *testing.T) {
+	store := NewRingHistoryStore(3)
+	store.Append("one")
+	store.Append("two")
+	store.Append("three")
+
+	got := store.Recent(10)
+	want := []string{"one", "two", "three"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Recent(10) = %v, want %v", got, want)
+	}
+
+	if got := store.Recent(2); !reflect.DeepEqual(got, []string{"two", "three"}) {
+		t.Fatalf("Recent(2) = %v, want [two three]", got)
+	}
+}
+
+func TestRingHistoryStoreEvictsOldestOnceFull(t *testing.T) {
+	store := NewRingHistoryStore(2)
+	store.Append("one")
+	store.Append("two")
+	store.Append("three")
+
+	want := []string{"two", "three"}
+	if got := store.Recent(10); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Recent(10) after overflow = %v, want %v", got, want)
+	}
+}
+
+func TestRingHistoryStoreSince(t *testing.T) {
+	store := NewRingHistoryStore(5)
+	store.append("old", time.Unix(0, 0))
+	cutoff := time.Unix(100, 0)
+	store.append("new", cutoff)
+
+	want := []string{"new"}
+	if got := store.Since(cutoff); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Since(cutoff) = %v, want %v", got, want)
+	}
+}
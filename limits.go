@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"time"
+)
+
+var (
+	maxInputLength = flag.Int("max-input-length", 512, "maximum length in bytes of a single line read from a client")
+	maxConnsPerIP  = flag.Int("max-per-ip", 3, "maximum number of simultaneous connections allowed from a single IP")
+	rateLimit      = flag.Float64("rate-limit", 5, "maximum messages per second a client may send, after bursting")
+	rateBurst      = flag.Int("rate-burst", 10, "maximum messages a client may send in a single burst")
+	idleTimeout    = flag.Duration("idle-timeout", 5*time.Minute, "how long a client may be idle before being sent a keepalive ping")
+	quitTimeout    = flag.Duration("quit-timeout", 30*time.Second, "how long a client has to respond to a keepalive ping before being disconnected")
+)
+
+var ErrLineTooLong = errors.New("line exceeds maximum input length")
+
+/* Reads a single newline-delimited line from reader, same as bufio.Reader.ReadString,
+but refuses to keep buffering a line that grows past maxLen instead of
+accumulating it unbounded in memory. The remainder of an oversized line is
+discarded up to and including its terminating newline so the stream resyncs */
+func readLine(reader *bufio.Reader, maxLen int) (string, error) {
+	var line []byte
+
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+
+		if len(line) > maxLen {
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+
+			return "", ErrLineTooLong
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		return string(line), err
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var stateDir = flag.String("state-dir", "", "directory used to persist chat rooms, users, and op/ban lists across restarts; disabled if empty")
+
+const (
+	roomsFile = "rooms.json"
+	usersFile = "users.json"
+	authFile  = "auth.json"
+)
+
+/* persistedChatRoom is the on-disk representation of a ChatRoom */
+type persistedChatRoom struct {
+	Name     string    `json:"name"`
+	Messages []string  `json:"messages"`
+	Expiry   time.Time `json:"expiry"`
+	Topic    string    `json:"topic"`
+}
+
+/* persistedAuth is the on-disk representation of the Auth subsystem's op and ban lists */
+type persistedAuth struct {
+	Ops  []string `json:"ops"`
+	Bans []string `json:"bans"`
+}
+
+/* Users stores registered nicknames and their SHA-256 hashed passwords,
+persisted to users.json under the configured state directory.
+Passwords are never stored or written to disk in plaintext */
+type Users struct {
+	mutex  sync.RWMutex
+	hashes map[string]string
+}
+
+/* Creates an empty set of registered users */
+func NewUsers() *Users {
+	return &Users{hashes: make(map[string]string)}
+}
+
+/* Hashes a password with SHA-256 for storage and comparison */
+func HashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+/* Reports whether the given name has a registered password */
+func (users *Users) IsRegistered(name string) bool {
+	users.mutex.RLock()
+	defer users.mutex.RUnlock()
+
+	_, ok := users.hashes[name]
+	return ok
+}
+
+/* Registers the given name with the given password, provided the name
+is not already registered */
+func (users *Users) Register(name, password string) bool {
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+
+	if _, ok := users.hashes[name]; ok {
+		return false
+	}
+
+	users.hashes[name] = HashPassword(password)
+	return true
+}
+
+/* Reports whether the given password matches the given registered name */
+func (users *Users) Identify(name, password string) bool {
+	users.mutex.RLock()
+	defer users.mutex.RUnlock()
+
+	hash, ok := users.hashes[name]
+	return ok && hash == HashPassword(password)
+}
+
+/* Loads persisted rooms, users and op/ban lists from the state directory.
+Returns empty state if no state directory was configured, or if this is
+the first run and the files do not yet exist.
+If historyDB is non-nil, reloaded rooms read their history straight from
+it rather than from the snapshot in rooms.json */
+func LoadState(auth *Auth, historyDB *sql.DB) (map[string]*ChatRoom, *Users) {
+	chatRooms := make(map[string]*ChatRoom)
+	users := NewUsers()
+
+	if *stateDir == "" {
+		return chatRooms, users
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(*stateDir, roomsFile)); err == nil {
+		var persisted []persistedChatRoom
+		if err := json.Unmarshal(data, &persisted); err != nil {
+			log.Println("Error decoding persisted rooms:", err)
+		} else {
+			for _, p := range persisted {
+				var history HistoryStore
+				if historyDB != nil {
+					history = NewSQLiteHistoryStore(historyDB, p.Name)
+				} else {
+					ring := NewRingHistoryStore(*historyCap)
+					for _, msg := range p.Messages {
+						ring.Append(msg)
+					}
+					history = ring
+				}
+
+				chatRooms[p.Name] = &ChatRoom{
+					name:    p.Name,
+					clients: make([]*Client, 0),
+					history: history,
+					expiry:  p.Expiry,
+					topic:   p.Topic,
+				}
+			}
+		}
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(*stateDir, usersFile)); err == nil {
+		if err := json.Unmarshal(data, &users.hashes); err != nil {
+			log.Println("Error decoding persisted users:", err)
+		}
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(*stateDir, authFile)); err == nil {
+		var persisted persistedAuth
+		if err := json.Unmarshal(data, &persisted); err != nil {
+			log.Println("Error decoding persisted auth lists:", err)
+		} else {
+			for _, fingerprint := range persisted.Ops {
+				auth.Op(fingerprint)
+			}
+			for _, fingerprint := range persisted.Bans {
+				auth.Ban(fingerprint)
+			}
+		}
+	}
+
+	log.Println("Loaded state from", *stateDir)
+	return chatRooms, users
+}
+
+/* Persists chat rooms, users and op/ban lists to the state directory.
+A no-op if no state directory was configured */
+func (lobby *Lobby) SaveState() {
+	if *stateDir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(*stateDir, 0700); err != nil {
+		log.Println("Error creating state directory:", err)
+		return
+	}
+
+	persisted := make([]persistedChatRoom, 0, len(lobby.chatRooms))
+	for _, chatRoom := range lobby.chatRooms {
+		entry := persistedChatRoom{
+			Name:   chatRoom.name,
+			Expiry: chatRoom.expiry,
+			Topic:  chatRoom.topic,
+		}
+
+		if lobby.historyDB == nil {
+			entry.Messages = chatRoom.history.Recent(*historyCap)
+		}
+
+		persisted = append(persisted, entry)
+	}
+	writeJSON(filepath.Join(*stateDir, roomsFile), persisted)
+
+	lobby.users.mutex.RLock()
+	writeJSON(filepath.Join(*stateDir, usersFile), lobby.users.hashes)
+	lobby.users.mutex.RUnlock()
+
+	writeJSON(filepath.Join(*stateDir, authFile), persistedAuth{
+		Ops:  lobby.auth.OpList(),
+		Bans: lobby.auth.BanList(),
+	})
+
+	log.Println("Saved state to", *stateDir)
+}
+
+/* Encodes v as indented JSON and writes it to path, logging but not
+returning any error so that callers can save best-effort on shutdown */
+func writeJSON(path string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Println("Error encoding state:", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		log.Println("Error writing state file:", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/* RateLimiter is a token bucket used to cap how many messages a client
+may send per second, refilling steadily up to its burst size */
+type RateLimiter struct {
+	mutex      sync.Mutex
+	tokens     float64
+	maxTokens  float64
+	refillRate float64
+	lastRefill time.Time
+}
+
+/* Creates a rate limiter that refills at ratePerSecond tokens a second,
+up to a maximum burst of burst tokens */
+func NewRateLimiter(ratePerSecond float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		tokens:     float64(burst),
+		maxTokens:  float64(burst),
+		refillRate: ratePerSecond,
+		lastRefill: time.Now(),
+	}
+}
+
+/* Reports whether a token is currently available, consuming it if so */
+func (limiter *RateLimiter) Allow() bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.lastRefill).Seconds() * limiter.refillRate
+	if limiter.tokens > limiter.maxTokens {
+		limiter.tokens = limiter.maxTokens
+	}
+	limiter.lastRefill = now
+
+	if limiter.tokens < 1 {
+		return false
+	}
+
+	limiter.tokens--
+	return true
+}
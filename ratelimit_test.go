@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowsUpToBurst(t *testing.T) {
+	limiter := NewRateLimiter(5, 3)
+
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow() {
+			t.Fatalf("token %d within burst should be allowed", i)
+		}
+	}
+
+	if limiter.Allow() {
+		t.Fatal("token beyond the burst should be rejected")
+	}
+}
+
+func TestRateLimiterRefillsOverTime(t *testing.T) {
+	limiter := NewRateLimiter(100, 1)
+
+	if !limiter.Allow() {
+		t.Fatal("first token should be allowed")
+	}
+	if limiter.Allow() {
+		t.Fatal("second token should be rejected before any refill")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if !limiter.Allow() {
+		t.Fatal("a token should be available once the bucket has had time to refill")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	SSHConnPort = ":2222"
+
+	ErrorBanned = ErrorPrefix + "You have been banned from this server.\n"
+)
+
+var (
+	sshEnabled = flag.Bool("ssh", false, "listen for SSH connections instead of plain TCP")
+	sshHostKey = flag.String("host-key", "host_key", "path to the SSH host private key")
+)
+
+/* Loads the SSH host key from disk and builds a server config that accepts
+any client public key, recording its fingerprint for the Auth subsystem
+instead of rejecting unrecognised keys outright */
+func NewSSHConfig(auth *Auth) (*ssh.ServerConfig, error) {
+	keyBytes, err := ioutil.ReadFile(*sshHostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKey, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			fingerprint := ssh.FingerprintSHA256(key)
+			if auth.IsBanned(fingerprint) {
+				return nil, fmt.Errorf("%s is banned", fingerprint)
+			}
+
+			if !auth.IsAllowed(fingerprint) {
+				return nil, fmt.Errorf("%s is not whitelisted", fingerprint)
+			}
+
+			return &ssh.Permissions{
+				Extensions: map[string]string{
+					"pubkey-fp": fingerprint,
+					"username":  meta.User(),
+				},
+			}, nil
+		},
+	}
+
+	config.AddHostKey(hostKey)
+	return config, nil
+}
+
+/* Listens for SSH connections and hands each authenticated session to the
+lobby as a PTY-backed chat terminal */
+func ListenSSH(lobby *Lobby, auth *Auth) {
+	config, err := NewSSHConfig(auth)
+	if err != nil {
+		log.Fatalln("Error loading SSH host key:", err)
+	}
+
+	listener, err := net.Listen(ConnType, SSHConnPort)
+	if err != nil {
+		log.Fatalln("Error: ", err)
+	}
+
+	defer listener.Close()
+	log.Println("Listening for SSH on " + SSHConnPort)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("Error: ", err)
+			continue
+		}
+
+		go acceptSSHSession(conn, config, lobby)
+	}
+}
+
+/* Performs the SSH handshake for a single connection, then waits for a
+session channel to turn into a chat client */
+func acceptSSHSession(conn net.Conn, config *ssh.ServerConfig, lobby *Lobby) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Println("SSH handshake failed:", err)
+		return
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Println("Could not accept channel:", err)
+			continue
+		}
+
+		go handleSSHRequests(requests, channel, sshConn, lobby)
+	}
+}
+
+/* Waits for the shell request an SSH chat client sends before treating the
+channel as a live terminal, then joins it to the lobby with its name
+defaulted to the SSH username, provided that username is well-formed - an
+unsanitized username would otherwise reach every other client's raw stream
+via join notices and chat lines, letting it forge protocol lines.
+pty-req is explicitly declined: we speak the same newline-delimited text
+protocol as plain TCP clients, with no echo or CR/LF translation of our
+own, so acking it would put the client's local terminal in raw mode
+expecting the server to own echo and line editing it never gets */
+func handleSSHRequests(requests <-chan *ssh.Request, channel ssh.Channel, sshConn *ssh.ServerConn, lobby *Lobby) {
+	for req := range requests {
+		switch req.Type {
+		case "shell":
+			req.Reply(true, nil)
+
+			client := NewClient(sshChannelConn{channel, sshConn})
+			client.pubKey = sshConn.Permissions.Extensions["pubkey-fp"]
+
+			if username := sshConn.Permissions.Extensions["username"]; nameRegex.MatchString(username) {
+				client.name = username
+			}
+
+			lobby.join <- client
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+/* Adapts an SSH channel to the net.Conn interface Client expects.
+Client only ever reads, writes and closes its connection, so the
+address and deadline methods are unused stubs */
+type sshChannelConn struct {
+	ssh.Channel
+	sshConn *ssh.ServerConn
+}
+
+func (c sshChannelConn) Close() error {
+	c.Channel.Close()
+	return c.sshConn.Close()
+}
+
+func (c sshChannelConn) LocalAddr() net.Addr                { return c.sshConn.LocalAddr() }
+func (c sshChannelConn) RemoteAddr() net.Addr               { return c.sshConn.RemoteAddr() }
+func (c sshChannelConn) SetDeadline(t time.Time) error      { return nil }
+func (c sshChannelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c sshChannelConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	FormatText = ""
+	FormatJSON = "json"
+)
+
+var (
+	wsEnabled = flag.Bool("ws", false, "also listen for WebSocket connections and serve the static web client")
+	wsAddr    = flag.String("ws-addr", ":8080", "address the WebSocket gateway and static web client listen on")
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+/* wsEnvelope is the JSON message format spoken by WebSocket clients,
+as opposed to the newline-delimited text protocol legacy TCP and SSH clients use */
+type wsEnvelope struct {
+	Type string    `json:"type"`
+	Room string    `json:"room"`
+	From string    `json:"from"`
+	Text string    `json:"text"`
+	TS   time.Time `json:"ts"`
+}
+
+/* Serves the WebSocket gateway and the static web client on wsAddr,
+so browsers can join the same lobby as native TCP and SSH clients */
+func ListenWS(lobby *Lobby) {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("web")))
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println("WebSocket upgrade failed:", err)
+			return
+		}
+
+		client := NewClient(&wsConn{ws: conn})
+		client.format = FormatJSON
+		lobby.join <- client
+	})
+
+	log.Println("Listening for WebSocket connections on " + *wsAddr)
+	if err := http.ListenAndServe(*wsAddr, mux); err != nil {
+		log.Fatalln("Error: ", err)
+	}
+}
+
+/* Adapts a gorilla WebSocket connection to the net.Conn interface Client
+expects. Reads are buffered across WebSocket frames since net.Conn.Read
+works on a byte stream rather than discrete messages */
+type wsConn struct {
+	ws      *websocket.Conn
+	pending []byte
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		c.pending = data
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error         { return c.ws.Close() }
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error      { return c.ws.UnderlyingConn().SetDeadline(t) }
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.UnderlyingConn().SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.UnderlyingConn().SetWriteDeadline(t) }
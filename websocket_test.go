@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+/* Exercises the WebSocket upgrade path the same way ListenWS's /ws handler
+does, without binding a real listener, and checks the client receives a
+well-formed JSON envelope once it joins the lobby */
+func TestWebSocketHandshakeJoinsLobby(t *testing.T) {
+	auth := NewAuth()
+	users := NewUsers()
+	lobby := NewLobby(auth, users, nil, nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+
+		client := NewClient(&wsConn{ws: conn})
+		client.format = FormatJSON
+		lobby.join <- client
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dialing websocket: %v", err)
+	}
+	defer conn.Close()
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading welcome message: %v", err)
+	}
+
+	var envelope wsEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatalf("decoding envelope %q: %v", data, err)
+	}
+
+	if !strings.Contains(envelope.Text, "Welcome") {
+		t.Fatalf("envelope.Text = %q, want it to contain %q", envelope.Text, "Welcome")
+	}
+}